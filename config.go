@@ -0,0 +1,106 @@
+package ldapsync
+
+import (
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DirectoryConfig describes how to reach the LDAP directory and which
+// entries/attributes are relevant for the sync.
+type DirectoryConfig struct {
+	Host     string `yaml:"host"`
+	Port     int64  `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Allusers string `yaml:"allusers"`
+
+	Frozen  []string                     `yaml:"frozen"`
+	Roles   map[string][]string          `yaml:"roles"`
+	Groups  map[string][]string          `yaml:"groups"`
+	Attrmap map[string]map[string]string `yaml:"attrmap"`
+
+	// GroupOrgs maps a group DN to the Uyuni organization ID new users
+	// found through that group should be created under.
+	GroupOrgs map[string]int64 `yaml:"group_orgs"`
+
+	// UseMemberOf enables the single scoped "memberOf" search for staged
+	// users. Defaults to true when unset; set to false to fall back to the
+	// per-group member walk for directories that don't maintain memberOf.
+	UseMemberOf *bool `yaml:"use_memberof"`
+
+	// DefaultMailDomain is used to synthesize an email as "<uid>@<domain>"
+	// when an entry has no mail attribute, if SynthesizeMissingEmail is set.
+	DefaultMailDomain      string `yaml:"default_mail_domain"`
+	SynthesizeMissingEmail bool   `yaml:"synthesize_missing_email"`
+
+	// LoginFromEmail derives the Uyuni login from the local part of the mail
+	// attribute when no uid can be resolved via the attribute map, for
+	// directories (typically AD) with no canonical uid attribute.
+	LoginFromEmail bool `yaml:"login_from_email"`
+
+	Url                string `yaml:"url"`
+	UseStartTLS        bool   `yaml:"use_starttls"`
+	CACertFile         string `yaml:"ca_cert_file"`
+	ClientCertFile     string `yaml:"client_cert_file"`
+	ClientKeyFile      string `yaml:"client_key_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
+}
+
+// SpacewalkConfig describes how to reach the Uyuni/Spacewalk XML-RPC API.
+type SpacewalkConfig struct {
+	Url      string `yaml:"url"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Checkssl bool   `yaml:"checkssl"`
+}
+
+// SyncConfig controls the scheduled daemon mode of the sync.
+type SyncConfig struct {
+	Interval       string `yaml:"interval"`
+	RunAtStart     bool   `yaml:"run_at_start"`
+	UpdateExisting bool   `yaml:"update_existing"`
+	DryRun         bool   `yaml:"dry_run"`
+
+	// RemovalPolicy is one of RemovalPolicyDelete, RemovalPolicyDisable or
+	// RemovalPolicyIgnore. Defaults to RemovalPolicyDelete when empty.
+	RemovalPolicy      string `yaml:"removal_policy"`
+	ReactivateOnReturn bool   `yaml:"reactivate_on_return"`
+}
+
+// Config is the root of the YAML configuration file.
+type Config struct {
+	Directory DirectoryConfig `yaml:"directory"`
+	Spacewalk SpacewalkConfig `yaml:"spacewalk"`
+	Sync      SyncConfig      `yaml:"sync"`
+}
+
+// ConfigReader loads and holds the parsed configuration.
+type ConfigReader struct {
+	path   string
+	config *Config
+}
+
+// NewConfigReader reads and parses the configuration file at cfgpath.
+func NewConfigReader(cfgpath string) *ConfigReader {
+	cr := new(ConfigReader)
+	cr.path = cfgpath
+	cr.config = new(Config)
+
+	data, err := ioutil.ReadFile(cr.path)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
+	if err := yaml.Unmarshal(data, cr.config); err != nil {
+		Log.Fatal(err)
+	}
+
+	return cr
+}
+
+// Config returns the parsed configuration.
+func (cr *ConfigReader) Config() *Config {
+	return cr.config
+}
@@ -1,18 +1,26 @@
 package ldapsync
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 
 	"github.com/go-ldap/ldap"
 )
 
 type LDAPCaller struct {
-	user     string
-	password string
-	host     string
-	proto    string
-	port     int64
-	conn     *ldap.Conn
+	user      string
+	password  string
+	host      string
+	proto     string
+	port      int64
+	url       string
+	useTLS    bool
+	tlsConfig *tls.Config
+	conn      *ldap.Conn
 }
 
 // Constructor of the LDAP caller with default options
@@ -49,14 +57,88 @@ func (lc *LDAPCaller) SetHost(host string) *LDAPCaller {
 	return lc
 }
 
-func (lc *LDAPCaller) Connect() {
+// SetURL configures the caller from an `ldap://` or `ldaps://` URL, taking
+// precedence over SetHost/SetPort/SetProto when set.
+func (lc *LDAPCaller) SetURL(url string) *LDAPCaller {
+	lc.url = url
+	return lc
+}
+
+// SetTLSConfig sets the TLS configuration used for `ldaps://` connections and,
+// when enabled, for StartTLS.
+func (lc *LDAPCaller) SetTLSConfig(tlsConfig *tls.Config) *LDAPCaller {
+	lc.tlsConfig = tlsConfig
+	return lc
+}
+
+// SetUseStartTLS enables issuing a StartTLS request right after connecting,
+// before any bind is attempted.
+func (lc *LDAPCaller) SetUseStartTLS(useStartTLS bool) *LDAPCaller {
+	lc.useTLS = useStartTLS
+	return lc
+}
+
+// Connect dials the directory server, optionally upgrading the connection
+// with StartTLS, and binds as the configured user. The connection is left
+// open for subsequent Search calls.
+func (lc *LDAPCaller) Connect() error {
+	if lc.conn != nil {
+		return nil
+	}
+
+	var conn *ldap.Conn
 	var err error
-	if lc.conn == nil {
-		lc.conn, err = ldap.Dial(lc.proto, fmt.Sprintf("%s:%d", lc.host, lc.port))
-		if err != nil {
-			Log.Fatal(err)
+	if lc.url != "" {
+		conn, err = dialURL(lc.url, lc.tlsConfig)
+	} else {
+		conn, err = ldap.Dial(lc.proto, fmt.Sprintf("%s:%d", lc.host, lc.port))
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot connect to LDAP server: %s", err.Error())
+	}
+
+	if lc.useTLS {
+		if err := conn.StartTLS(lc.tlsConfig); err != nil {
+			conn.Close()
+			return fmt.Errorf("StartTLS negotiation failed: %s", err.Error())
 		}
 	}
+
+	if err := conn.Bind(lc.user, lc.password); err != nil {
+		conn.Close()
+		return fmt.Errorf("Cannot bind as '%s': %s", lc.user, err.Error())
+	}
+
+	lc.conn = conn
+	return nil
+}
+
+// dialURL connects to an ldap:// or ldaps:// URL. This repo's go-ldap import
+// path is the unversioned one (the later code lives under .../ldap/v3); its
+// DialURL takes no TLS options and builds its own bare tls.Config for
+// ldaps://, which would silently drop CACertFile/ClientCertFile/
+// ClientKeyFile/InsecureSkipVerify/ServerName. So ldaps:// is dialed directly
+// with DialTLS and the constructed tlsConfig instead.
+func dialURL(rawurl string, tlsConfig *tls.Config) (*ldap.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse LDAP URL '%s': %s", rawurl, err.Error())
+	}
+
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if u.Scheme == "ldaps" {
+			host = net.JoinHostPort(host, "636")
+		} else {
+			host = net.JoinHostPort(host, "389")
+		}
+	}
+
+	if u.Scheme == "ldaps" {
+		return ldap.DialTLS("tcp", host, tlsConfig)
+	}
+
+	return ldap.Dial("tcp", host)
 }
 
 func (lc *LDAPCaller) Disconnect() {
@@ -66,10 +148,56 @@ func (lc *LDAPCaller) Disconnect() {
 	}
 }
 
-func (lc *LDAPCaller) Search(request *ldap.SearchRequest) *ldap.SearchResult {
+// Search returns an error instead of failing hard, so that a transient
+// directory hiccup only fails the current sync cycle instead of killing the
+// daemon (see SyncScheduler.runOnce).
+func (lc *LDAPCaller) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
 	res, err := lc.conn.Search(request)
 	if err != nil {
-		Log.Fatal(err)
+		return nil, fmt.Errorf("LDAP search failed: %s", err.Error())
 	}
-	return res
+	return res, nil
+}
+
+// SearchPaged runs request using the LDAP paged-results control, transparently
+// fetching pageSize entries at a time. Use this instead of Search for any
+// search that can return more entries than the server's SizeLimit allows.
+func (lc *LDAPCaller) SearchPaged(request *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error) {
+	res, err := lc.conn.SearchWithPaging(request, pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("LDAP paged search failed: %s", err.Error())
+	}
+	return res, nil
+}
+
+// newTLSConfig builds a *tls.Config from the directory's LDAPS/StartTLS
+// settings: an optional CA bundle, an optional client certificate/key pair,
+// and the InsecureSkipVerify/ServerName overrides.
+func newTLSConfig(dir DirectoryConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: dir.InsecureSkipVerify,
+		ServerName:         dir.ServerName,
+	}
+
+	if dir.CACertFile != "" {
+		caCert, err := ioutil.ReadFile(dir.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read CA bundle '%s': %s", dir.CACertFile, err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in CA bundle '%s'", dir.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if dir.ClientCertFile != "" && dir.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(dir.ClientCertFile, dir.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate/key: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
@@ -1,6 +1,7 @@
 package ldapsync
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -15,31 +16,76 @@ func init() {
 	Log = logrus.New()
 }
 
+// Removal policies for users that are in Uyuni but no longer found in LDAP.
+const (
+	RemovalPolicyDelete  = "delete"
+	RemovalPolicyDisable = "disable"
+	RemovalPolicyIgnore  = "ignore"
+)
+
 type SearchConfig struct {
 	config    *map[string][]string
 	filter    string
 	attribute string
 }
 
+// ldapSearcher is the subset of LDAPCaller that LDAPSync depends on, pulled
+// out as an interface so tests can substitute a fake searcher instead of
+// dialing a real directory.
+type ldapSearcher interface {
+	Connect() error
+	Disconnect()
+	Search(request *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SearchPaged(request *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error)
+}
+
 type LDAPSync struct {
-	lc           *LDAPCaller
+	lc           ldapSearcher
 	uc           *UyuniCaller
 	cr           *ConfigReader
 	ldapusers    []*UyuniUser
 	uyuniusers   []*UyuniUser
 	allldapusers []*UyuniUser
 	roleConfigs  [2]*SearchConfig
+
+	dryRun         bool
+	updateExisting bool
+
+	removalPolicy      string
+	reactivateOnReturn bool
+
+	useMemberOf bool
 }
 
+// defaultPageSize is used for all paged LDAP searches.
+const defaultPageSize uint32 = 500
+
 func NewLDAPSync(cfgpath string) *LDAPSync {
 	sync := new(LDAPSync)
 	sync.cr = NewConfigReader(cfgpath)
-	sync.lc = NewLDAPCaller().
+
+	lc := NewLDAPCaller().
 		SetHost(sync.cr.Config().Directory.Host).
 		SetPort(sync.cr.Config().Directory.Port).
 		SetUser(sync.cr.Config().Directory.User).
 		SetPassword(sync.cr.Config().Directory.Password)
 
+	if sync.cr.Config().Directory.Url != "" {
+		lc.SetURL(sync.cr.Config().Directory.Url)
+	}
+	lc.SetUseStartTLS(sync.cr.Config().Directory.UseStartTLS)
+
+	tlsConfig, err := newTLSConfig(sync.cr.Config().Directory)
+	if err != nil {
+		Log.Fatalf("Cannot build TLS configuration: %s", err.Error())
+	}
+	lc.SetTLSConfig(tlsConfig)
+
+	// sync.lc is the narrower ldapSearcher interface so tests can substitute
+	// a fake searcher; construction-time configuration happens on the
+	// concrete *LDAPCaller above, before it's stored here.
+	sync.lc = lc
+
 	sync.uc = NewUyuniCaller(sync.cr.Config().Spacewalk.Url, !sync.cr.Config().Spacewalk.Checkssl).
 		SetUser(sync.cr.Config().Spacewalk.User).
 		SetPassword(sync.cr.Config().Spacewalk.Password)
@@ -53,6 +99,18 @@ func NewLDAPSync(cfgpath string) *LDAPSync {
 		&SearchConfig{config: &sync.cr.Config().Directory.Groups,
 			filter: "(|(objectClass=groupOfNames)(objectClass=group))", attribute: "member"},
 	}
+
+	sync.dryRun = sync.cr.Config().Sync.DryRun
+	sync.updateExisting = sync.cr.Config().Sync.UpdateExisting
+
+	sync.removalPolicy = sync.cr.Config().Sync.RemovalPolicy
+	if sync.removalPolicy == "" {
+		sync.removalPolicy = RemovalPolicyDelete
+	}
+	sync.reactivateOnReturn = sync.cr.Config().Sync.ReactivateOnReturn
+
+	sync.useMemberOf = sync.cr.Config().Directory.UseMemberOf == nil || *sync.cr.Config().Directory.UseMemberOf
+
 	return sync
 }
 
@@ -60,26 +118,69 @@ func (sync *LDAPSync) ConfigReader() *ConfigReader {
 	return sync.cr
 }
 
-func (sync *LDAPSync) Start() *LDAPSync {
-	sync.lc.Connect()
+// SetDryRun toggles dry-run mode, where planned XML-RPC calls are logged
+// instead of executed.
+func (sync *LDAPSync) SetDryRun(dryRun bool) *LDAPSync {
+	sync.dryRun = dryRun
+	return sync
+}
+
+// SetUpdateExisting toggles whether outdated users already present in Uyuni
+// are updated ("create only" when false, full create/update/disable when true).
+func (sync *LDAPSync) SetUpdateExisting(updateExisting bool) *LDAPSync {
+	sync.updateExisting = updateExisting
+	return sync
+}
+
+// Run starts the scheduled daemon mode, syncing on the configured interval
+// until ctx is cancelled or a SIGINT/SIGTERM is received.
+func (sync *LDAPSync) Run(ctx context.Context) error {
+	return NewSyncScheduler(sync).Run(ctx)
+}
 
-	sync.verifyIgnoredUsers()
-	sync.refreshExistingUyuniUsers()
-	sync.refreshStagedLDAPUsers()
-	sync.refreshAllLDAPUsers()
+// Start connects to the LDAP server and refreshes all internal user state.
+// It returns an error instead of failing hard so that daemon mode (Run) can
+// survive a transient directory outage and retry on the next tick.
+func (sync *LDAPSync) Start() (*LDAPSync, error) {
+	if err := sync.lc.Connect(); err != nil {
+		return sync, err
+	}
+
+	if err := sync.verifyIgnoredUsers(); err != nil {
+		return sync, err
+	}
+	if _, err := sync.refreshExistingUyuniUsers(); err != nil {
+		return sync, err
+	}
+	if _, err := sync.refreshStagedLDAPUsers(); err != nil {
+		return sync, err
+	}
+	if _, err := sync.refreshAllLDAPUsers(); err != nil {
+		return sync, err
+	}
 	sync.refreshUyuniUsersStatus()
 
-	return sync
+	return sync, nil
 }
 
 func (sync *LDAPSync) Finish() {
 	sync.lc.Disconnect()
 }
 
+// sameIdentity reports whether two users are the same account: primarily by
+// uid, falling back to a case-insensitive email match when either side's uid
+// is empty (AD directories configured without a canonical uid attribute).
+func sameIdentity(a, b *UyuniUser) bool {
+	if a.Uid != "" && b.Uid != "" {
+		return a.Uid == b.Uid
+	}
+	return a.Email != "" && strings.EqualFold(a.Email, b.Email)
+}
+
 // Helper function that looks for the same user or at least its ID
 func (sync LDAPSync) in(user UyuniUser, users []*UyuniUser) bool {
 	for _, u := range users {
-		if u.Uid == user.Uid {
+		if sameIdentity(&user, u) {
 			return true
 		}
 	}
@@ -89,7 +190,19 @@ func (sync LDAPSync) in(user UyuniUser, users []*UyuniUser) bool {
 // Match a given user by a DN, compare all metadata.
 func (sync LDAPSync) sameAsIn(user *UyuniUser, users []*UyuniUser) (bool, error) {
 	for _, u := range users {
-		if u.Uid == user.Uid {
+		if sameIdentity(user, u) {
+			if u.disabled {
+				if !sync.reactivateOnReturn {
+					Log.Debugf("User %s has returned but reactivate_on_return is disabled, leaving disabled", user.Uid)
+					return true, nil
+				}
+
+				user.reactivate = true
+				user.accountchanged = true
+				Log.Debugf("User %s has returned to LDAP and will be reactivated", user.Uid)
+				return false, nil
+			}
+
 			same := u.Email == user.Email
 			if same {
 				same = u.Name == user.Name
@@ -129,7 +242,7 @@ func (sync LDAPSync) sameAsIn(user *UyuniUser, users []*UyuniUser) (bool, error)
 // Returns a copy of LDAP user by Uyuni user
 func (sync *LDAPSync) updateFromLDAPUser(uyuniUser *UyuniUser) {
 	for _, ldapUser := range sync.ldapusers {
-		if ldapUser.Uid == uyuniUser.Uid {
+		if sameIdentity(ldapUser, uyuniUser) {
 			uyuniUser.Name, uyuniUser.Secondname, uyuniUser.Email = ldapUser.Name, ldapUser.Secondname, ldapUser.Email
 			uyuniUser.FlushRoles()
 			for _, role := range ldapUser.GetRoles() {
@@ -187,7 +300,12 @@ func (sync *LDAPSync) SyncUsers() []*UyuniUser {
 		Log.Debugf("Found %d new users", len(newUsers))
 		for _, user := range newUsers {
 			Log.Debugf("New user: %s", user.Uid)
-			_, user.Err = sync.uc.Call("user.create", sync.uc.Session(), user.Uid, "", user.Name, user.Secondname, user.Email, 1)
+			if sync.dryRun {
+				Log.Infof("[dry-run] Would create user '%s'", user.Uid)
+				continue
+			}
+
+			_, user.Err = sync.uc.Call("user.create", sync.uc.Session(), user.Uid, "", user.Name, user.Secondname, user.Email, user.OrgID)
 
 			if !user.IsValid() {
 				failed = append(failed, user)
@@ -199,10 +317,16 @@ func (sync *LDAPSync) SyncUsers() []*UyuniUser {
 	}
 
 	existingUsers := sync.GetOutdatedUsers()
-	if len(existingUsers) > 0 {
+	if !sync.updateExisting {
+		Log.Debug("Skipping update of existing users: update_existing is disabled")
+		existingUsers = nil
+	} else if len(existingUsers) > 0 {
 		Log.Debugf("Updating %d users", len(existingUsers))
 		for _, user := range existingUsers {
 			Log.Debugf("Update data for user: %s", user.Uid)
+			if user.NeedsReactivation() {
+				sync.reactivateUser(user)
+			}
 			sync.pushUserRolesToUyuni(user)
 			sync.pushUserAccountDataToUyuni(user)
 		}
@@ -223,16 +347,61 @@ func (sync *LDAPSync) SyncUsers() []*UyuniUser {
 	return failed
 }
 
-// Remove user from the Uyuni
+// Remove a user no longer found in LDAP, following the configured removal
+// policy: delete it outright, disable it, or leave it untouched. Nothing is
+// done while update_existing is disabled ("create only").
 func (sync *LDAPSync) deleteUser(uyuniUser *UyuniUser) {
-	_, err := sync.uc.Call("user.delete", sync.uc.Session(), uyuniUser.Uid)
+	if !sync.updateExisting {
+		Log.Debugf("update_existing is disabled, leaving user '%s' untouched", uyuniUser.Uid)
+		return
+	}
+
+	switch sync.removalPolicy {
+	case RemovalPolicyIgnore:
+		Log.Debugf("Removal policy is 'ignore', leaving user '%s' untouched", uyuniUser.Uid)
+		return
+	case RemovalPolicyDisable:
+		if sync.dryRun {
+			Log.Infof("[dry-run] Would disable user '%s'", uyuniUser.Uid)
+			return
+		}
+		_, err := sync.uc.Call("user.disable", sync.uc.Session(), uyuniUser.Uid)
+		if err != nil {
+			Log.Errorf("Cannot disable user '%s': %s", uyuniUser.Uid, err.Error())
+		}
+	default:
+		if sync.dryRun {
+			Log.Infof("[dry-run] Would delete user '%s'", uyuniUser.Uid)
+			return
+		}
+		_, err := sync.uc.Call("user.delete", sync.uc.Session(), uyuniUser.Uid)
+		if err != nil {
+			Log.Errorf("Cannot delete users '%s': %s", uyuniUser.Uid, err.Error())
+		}
+	}
+}
+
+// reactivateUser re-enables a Uyuni user that had been disabled and has since
+// reappeared in LDAP, when reactivate_on_return is enabled.
+func (sync *LDAPSync) reactivateUser(user *UyuniUser) {
+	if sync.dryRun {
+		Log.Infof("[dry-run] Would reactivate user '%s'", user.Uid)
+		return
+	}
+
+	_, err := sync.uc.Call("user.enable", sync.uc.Session(), user.Uid)
 	if err != nil {
-		Log.Errorf("Cannot delete users '%s': %s", uyuniUser.Uid, err.Error())
+		Log.Errorf("Cannot reactivate user '%s': %s", user.Uid, err.Error())
 	}
 }
 
 // Push account data to Uyuni
 func (sync *LDAPSync) pushUserAccountDataToUyuni(user *UyuniUser) {
+	if sync.dryRun {
+		Log.Infof("[dry-run] Would push account data for user '%s'", user.Uid)
+		return
+	}
+
 	_, err := sync.uc.Call("user.setDetails", sync.uc.Session(), user.Uid, map[string]string{
 		"first_name": user.Name, "last_name": user.Secondname, "email": user.Email})
 	if err != nil {
@@ -249,6 +418,11 @@ func (sync *LDAPSync) pushUserAccountDataToUyuni(user *UyuniUser) {
 
 // Sync user roles
 func (sync *LDAPSync) pushUserRolesToUyuni(uyuniUser *UyuniUser) {
+	if sync.dryRun {
+		Log.Infof("[dry-run] Would sync roles for user '%s' to %v", uyuniUser.Uid, uyuniUser.GetRoles())
+		return
+	}
+
 	// Remove current roles away
 	ret, err := sync.uc.Call("user.listRoles", sync.uc.Session(), uyuniUser.Uid)
 	if err != nil {
@@ -288,8 +462,13 @@ func (sync LDAPSync) getAttributes(entry *ldap.Entry, attr ...string) string {
 	return ""
 }
 
-// At least one ignored/frozen user must have org_admin role
-func (sync *LDAPSync) verifyIgnoredUsers() {
+// At least one ignored/frozen user must have org_admin role. This is a
+// configuration safety check, not a transient-error guard, so a genuine
+// "no org_admin found" is still reported as an error (the sync must not
+// risk permanently locking the Uyuni server) - but as a returned error
+// rather than Log.Fatal, so a transient Uyuni API hiccup only skips this
+// sync cycle instead of killing the daemon.
+func (sync *LDAPSync) verifyIgnoredUsers() error {
 	valid := false
 	for _, uid := range sync.cr.Config().Directory.Frozen {
 		res, err := sync.uc.Call("user.listRoles", sync.uc.Session(), uid)
@@ -306,9 +485,11 @@ func (sync *LDAPSync) verifyIgnoredUsers() {
 	}
 End:
 	if !valid {
-		Log.Fatal("In Uyuni server no actual frozen accounts found with the role 'org_admin'. " +
+		return fmt.Errorf("In Uyuni server no actual frozen accounts found with the role 'org_admin'. " +
 			"You are risking permanently locking Uyuni server, if you have incorrect LDAP users settings.")
 	}
+
+	return nil
 }
 
 // Refresh what users are new and what needs update
@@ -326,8 +507,9 @@ func (sync *LDAPSync) refreshUyuniUsersStatus() []*UyuniUser {
 		}
 
 		for _, uUuser := range sync.uyuniusers {
-			if uUuser.Uid == user.Uid {
+			if sameIdentity(uUuser, user) {
 				uUuser.outdated = user.outdated
+				uUuser.reactivate = user.reactivate
 				uUuser.Name = user.Name
 				uUuser.Secondname = user.Secondname
 				uUuser.Email = user.Email
@@ -341,12 +523,14 @@ func (sync *LDAPSync) refreshUyuniUsersStatus() []*UyuniUser {
 	return sync.uyuniusers
 }
 
-// Get all existing users in Uyuni.
-func (sync *LDAPSync) refreshExistingUyuniUsers() []*UyuniUser {
+// Get all existing users in Uyuni. Returns an error instead of Log.Fatal on
+// any XML-RPC failure, so a transient Uyuni outage only skips this sync
+// cycle instead of killing the daemon (see Start).
+func (sync *LDAPSync) refreshExistingUyuniUsers() ([]*UyuniUser, error) {
 	sync.uyuniusers = nil
 	res, err := sync.uc.Call("user.listUsers", sync.uc.Session())
 	if err != nil {
-		Log.Fatal(err)
+		return nil, fmt.Errorf("Cannot list Uyuni users: %s", err.Error())
 	}
 	for _, usrdata := range res.([]interface{}) {
 		uid := usrdata.(map[string]interface{})["login"].(string)
@@ -359,18 +543,21 @@ func (sync *LDAPSync) refreshExistingUyuniUsers() []*UyuniUser {
 
 		res, err = sync.uc.Call("user.getDetails", sync.uc.Session(), user.Uid)
 		if err != nil {
-			Log.Fatal(err)
+			return nil, fmt.Errorf("Cannot get details for user '%s': %s", user.Uid, err.Error())
 		}
 		userDetails := res.(map[string]interface{})
 
 		user.Email = userDetails["email"].(string)
 		user.Name = userDetails["first_name"].(string)
 		user.Secondname = userDetails["last_name"].(string)
+		if enabled, ok := userDetails["enabled"].(bool); ok {
+			user.disabled = !enabled
+		}
 
 		// Get user roles
 		res, err = sync.uc.Call("user.listRoles", sync.uc.Session(), user.Uid)
 		if err != nil {
-			Log.Fatal(err)
+			return nil, fmt.Errorf("Cannot list roles for user '%s': %s", user.Uid, err.Error())
 		}
 
 		for _, roleItf := range res.([]interface{}) {
@@ -379,7 +566,7 @@ func (sync *LDAPSync) refreshExistingUyuniUsers() []*UyuniUser {
 
 		sync.uyuniusers = append(sync.uyuniusers, user)
 	}
-	return sync.uyuniusers
+	return sync.uyuniusers, nil
 }
 
 // Get an attribute name for DN.
@@ -396,49 +583,149 @@ func (sync *LDAPSync) getAttributeNameFor(attr string) string {
 	return attr
 }
 
-func (sync *LDAPSync) newUserFromDN(dn string) *UyuniUser {
+func (sync *LDAPSync) newUserFromDN(dn string) (*UyuniUser, error) {
 	user := NewUyuniUser()
 	request := ldap.NewSearchRequest(dn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		"(objectClass=*)", []string{}, nil)
 
-	entries := sync.lc.Search(request).Entries
+	res, err := sync.lc.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := res.Entries
 	if len(entries) == 1 {
-		entry := entries[0]
-		user.Dn = entry.DN
-		user.Uid = entry.GetAttributeValue(sync.getAttributeNameFor("uid"))
-		user.Email = entry.GetAttributeValue(sync.getAttributeNameFor("mail"))
-
-		cn := strings.Split(entry.GetAttributeValue("cn"), " ")
-		if len(cn) == 2 {
-			user.Name, user.Secondname = cn[0], cn[1]
-		} else {
-			user.Name = sync.getAttributes(entry, sync.getAttributeNameFor("name"), sync.getAttributeNameFor("givenName"))
-			user.Secondname = entry.GetAttributeValue(sync.getAttributeNameFor("sn"))
-		}
+		sync.populateUserFromEntry(user, entries[0])
 	} else {
 		Log.Errorf("DN '%s' matches more or less than one distinct user", dn)
 	}
 
+	return user, nil
+}
+
+// newUserFromEntry builds a user directly from an already fetched LDAP entry,
+// avoiding a round-trip for directories that can be searched in bulk.
+func (sync *LDAPSync) newUserFromEntry(entry *ldap.Entry) *UyuniUser {
+	user := NewUyuniUser()
+	sync.populateUserFromEntry(user, entry)
 	return user
 }
 
+func (sync *LDAPSync) populateUserFromEntry(user *UyuniUser, entry *ldap.Entry) {
+	user.Dn = entry.DN
+	user.Uid = entry.GetAttributeValue(sync.getAttributeNameFor("uid"))
+	user.Email = entry.GetAttributeValue(sync.getAttributeNameFor("mail"))
+
+	if user.Email == "" && user.Uid != "" && sync.cr.Config().Directory.SynthesizeMissingEmail {
+		domain := sync.cr.Config().Directory.DefaultMailDomain
+		user.Email = fmt.Sprintf("%s@%s", user.Uid, domain)
+		Log.Debugf("User %s has no mail attribute, synthesized '%s'", user.Uid, user.Email)
+	}
+
+	if user.Uid == "" && user.Email != "" && sync.cr.Config().Directory.LoginFromEmail {
+		user.Uid = strings.SplitN(user.Email, "@", 2)[0]
+		Log.Debugf("Entry '%s' has no uid attribute, derived login '%s' from email '%s'", entry.DN, user.Uid, user.Email)
+	}
+
+	cn := strings.Split(entry.GetAttributeValue("cn"), " ")
+	if len(cn) == 2 {
+		user.Name, user.Secondname = cn[0], cn[1]
+	} else {
+		user.Name = sync.getAttributes(entry, sync.getAttributeNameFor("name"), sync.getAttributeNameFor("givenName"))
+		user.Secondname = entry.GetAttributeValue(sync.getAttributeNameFor("sn"))
+	}
+}
+
+// isEligibleLDAPUser reports whether a staged user has enough data to be
+// pushed to Uyuni: a resolved uid, not frozen, and a non-empty email. Uyuni's
+// user.create rejects an empty email, so such users are logged and excluded
+// rather than silently pushed.
+func (sync *LDAPSync) isEligibleLDAPUser(user *UyuniUser) bool {
+	if user.Uid == "" {
+		return false
+	}
+
+	if funk.Contains(sync.cr.Config().Directory.Frozen, user.Uid) {
+		return false
+	}
+
+	if user.Email == "" {
+		Log.Warnf("User %s has no email and synthesize_missing_email is disabled, excluding from sync", user.Uid)
+		return false
+	}
+
+	return true
+}
+
 // Get all users from LDAP, regardless are they are meant to be in the Uyuni
-func (sync *LDAPSync) refreshAllLDAPUsers() []*UyuniUser {
+func (sync *LDAPSync) refreshAllLDAPUsers() ([]*UyuniUser, error) {
 	sync.allldapusers = nil
 	request := ldap.NewSearchRequest(sync.cr.Config().Directory.Allusers,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		"(objectClass=organizationalPerson)", []string{}, nil)
 
-	for _, entry := range sync.lc.Search(request).Entries {
-		sync.allldapusers = append(sync.allldapusers, sync.newUserFromDN(entry.DN))
+	res, err := sync.lc.SearchPaged(request, defaultPageSize)
+	if err != nil {
+		return nil, err
 	}
 
-	return sync.allldapusers
+	for _, entry := range res.Entries {
+		sync.allldapusers = append(sync.allldapusers, sync.newUserFromEntry(entry))
+	}
+
+	return sync.allldapusers, nil
 }
 
-// Get existing LDAP users, based on the groups mapping
-func (sync *LDAPSync) refreshStagedLDAPUsers() []*UyuniUser {
+// Get existing LDAP users, based on the groups mapping.
+func (sync *LDAPSync) refreshStagedLDAPUsers() ([]*UyuniUser, error) {
 	sync.ldapusers = nil
+
+	if sync.useMemberOf {
+		return sync.refreshStagedLDAPUsersByMemberOf()
+	}
+
+	return sync.refreshStagedLDAPUsersByGroupWalk()
+}
+
+// refreshStagedLDAPUsersByMemberOf does a single scoped search under Allusers
+// with a composite memberOf filter, instead of a per-group search followed by
+// a per-member lookup. Requires the directory to maintain the memberOf
+// back-reference on user entries.
+func (sync *LDAPSync) refreshStagedLDAPUsersByMemberOf() ([]*UyuniUser, error) {
+	var terms strings.Builder
+	for _, roleset := range []map[string][]string{sync.cr.Config().Directory.Groups, sync.cr.Config().Directory.Roles} {
+		for gdn := range roleset {
+			terms.WriteString(fmt.Sprintf("(memberOf=%s)", ldap.EscapeFilter(gdn)))
+		}
+	}
+
+	filter := fmt.Sprintf("(&(objectClass=organizationalPerson)(|%s))", terms.String())
+	request := ldap.NewSearchRequest(sync.cr.Config().Directory.Allusers,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{}, nil)
+
+	res, err := sync.lc.SearchPaged(request, defaultPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range res.Entries {
+		user := sync.newUserFromEntry(entry)
+		if sync.isEligibleLDAPUser(user) {
+			if err := sync.updateLDAPUserRoles(user); err != nil {
+				return nil, err
+			}
+			sync.ldapusers = append(sync.ldapusers, user)
+		}
+	}
+
+	return sync.ldapusers, nil
+}
+
+// refreshStagedLDAPUsersByGroupWalk is the legacy fallback: walk every
+// configured group/role, collect its member DNs, then look each one up
+// individually. O(members) round-trips; used only when the directory does
+// not maintain memberOf.
+func (sync *LDAPSync) refreshStagedLDAPUsersByGroupWalk() ([]*UyuniUser, error) {
 	udns := make(map[string]bool)
 
 	// Get all *distinct* user DNs from the "member" attiribute across all the groups
@@ -446,7 +733,11 @@ func (sync *LDAPSync) refreshStagedLDAPUsers() []*UyuniUser {
 		for gdn := range roleset {
 			request := ldap.NewSearchRequest(gdn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 				"(objectClass=*)", []string{}, nil)
-			for _, entry := range sync.lc.Search(request).Entries {
+			res, err := sync.lc.SearchPaged(request, defaultPageSize)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range res.Entries {
 				for _, udn := range append(entry.GetAttributeValues("member"), entry.GetAttributeValues("roleOccupant")...) {
 					udns[udn] = true
 				}
@@ -456,32 +747,74 @@ func (sync *LDAPSync) refreshStagedLDAPUsers() []*UyuniUser {
 
 	// Collect users data
 	for udn := range udns {
-		user := sync.newUserFromDN(udn)
-		if user.Uid != "" && !funk.Contains(sync.cr.Config().Directory.Frozen, user.Uid) {
-			sync.updateLDAPUserRoles(user)
+		user, err := sync.newUserFromDN(udn)
+		if err != nil {
+			return nil, err
+		}
+		if sync.isEligibleLDAPUser(user) {
+			if err := sync.updateLDAPUserRoles(user); err != nil {
+				return nil, err
+			}
 			sync.ldapusers = append(sync.ldapusers, user)
 		}
 	}
 
-	return sync.ldapusers
+	return sync.ldapusers, nil
 }
 
-func (sync *LDAPSync) mergeRolesByAttributes(dn string, user *UyuniUser, filter string, attribute string, uyuniRoles []string) {
+func (sync *LDAPSync) mergeRolesByAttributes(dn string, user *UyuniUser, filter string, attribute string, uyuniRoles []string) error {
 	req := ldap.NewSearchRequest(dn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, []string{}, nil)
-	for _, entry := range sync.lc.Search(req).Entries {
+	res, err := sync.lc.SearchPaged(req, defaultPageSize)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range res.Entries {
 		for _, roleDn := range entry.GetAttributeValues(attribute) {
 			if roleDn == user.Dn {
 				user.AddRoles(uyuniRoles...)
 			}
 		}
 	}
+
+	return nil
 }
 
 // Get LDAP organizationalRole based on configuration
-func (sync *LDAPSync) updateLDAPUserRoles(user *UyuniUser) {
+func (sync *LDAPSync) updateLDAPUserRoles(user *UyuniUser) error {
 	for _, searchConfig := range sync.roleConfigs {
 		for dn, uyuniRoles := range *searchConfig.config {
-			sync.mergeRolesByAttributes(dn, user, searchConfig.filter, searchConfig.attribute, uyuniRoles)
+			if err := sync.mergeRolesByAttributes(dn, user, searchConfig.filter, searchConfig.attribute, uyuniRoles); err != nil {
+				return err
+			}
 		}
 	}
+
+	return sync.updateLDAPUserOrg(user)
+}
+
+// Assign the target Uyuni organization for a user based on the group_orgs
+// mapping, so a newly created user lands in the right org. Uses SearchPaged,
+// like every other group-membership search in this file, so org assignment
+// doesn't silently truncate on any org-mapped group larger than the server's
+// result cap.
+func (sync *LDAPSync) updateLDAPUserOrg(user *UyuniUser) error {
+	for dn, orgID := range sync.cr.Config().Directory.GroupOrgs {
+		req := ldap.NewSearchRequest(dn, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(|(objectClass=groupOfNames)(objectClass=group))", []string{}, nil)
+		res, err := sync.lc.SearchPaged(req, defaultPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range res.Entries {
+			for _, memberDn := range entry.GetAttributeValues("member") {
+				if memberDn == user.Dn {
+					user.OrgID = orgID
+				}
+			}
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,127 @@
+package ldapsync
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/go-ldap/ldap"
+)
+
+// countingSearcher is a fake ldapSearcher that serves canned entries and
+// counts how many times each search method was invoked, without dialing a
+// real directory.
+type countingSearcher struct {
+	entries          []*ldap.Entry
+	searchCalls      int
+	searchPagedCalls int
+}
+
+func (s *countingSearcher) Connect() error { return nil }
+func (s *countingSearcher) Disconnect()    {}
+
+func (s *countingSearcher) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.searchCalls++
+	return &ldap.SearchResult{Entries: s.entries}, nil
+}
+
+func (s *countingSearcher) SearchPaged(request *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error) {
+	s.searchPagedCalls++
+	return &ldap.SearchResult{Entries: s.entries}, nil
+}
+
+// TestRefreshStagedLDAPUsersByMemberOfIsOnePerCycle asserts that the memberOf
+// staging search is a single LDAP round-trip regardless of how many members
+// the configured groups have, as opposed to the legacy group-walk fallback's
+// per-member lookups. The fixture's roleConfigs and GroupOrgs are empty, so
+// no role or org lookups run; with mappings configured, updateLDAPUserRoles
+// still issues one paged search per mapped group for every staged user.
+func TestRefreshStagedLDAPUsersByMemberOfIsOnePerCycle(t *testing.T) {
+	const memberCount = 250
+
+	entries := make([]*ldap.Entry, 0, memberCount)
+	for i := 0; i < memberCount; i++ {
+		uid := fmt.Sprintf("user%d", i)
+		entries = append(entries, ldap.NewEntry(fmt.Sprintf("uid=%s,ou=people,dc=example,dc=com", uid), map[string][]string{
+			"uid":  {uid},
+			"mail": {uid + "@example.com"},
+			"cn":   {uid + " Test"},
+		}))
+	}
+
+	searcher := &countingSearcher{entries: entries}
+	sync := &LDAPSync{
+		lc: searcher,
+		cr: &ConfigReader{config: &Config{
+			Directory: DirectoryConfig{
+				Allusers: "ou=people,dc=example,dc=com",
+				Groups:   map[string][]string{"cn=admins,ou=groups,dc=example,dc=com": {"org_admin"}},
+			},
+		}},
+		useMemberOf: true,
+		roleConfigs: [2]*SearchConfig{
+			{config: &map[string][]string{}, filter: "(objectClass=organizationalRole)", attribute: "roleOccupant"},
+			{config: &map[string][]string{}, filter: "(|(objectClass=groupOfNames)(objectClass=group))", attribute: "member"},
+		},
+	}
+
+	users, err := sync.refreshStagedLDAPUsersByMemberOf()
+	if err != nil {
+		t.Fatalf("refreshStagedLDAPUsersByMemberOf() returned error: %s", err)
+	}
+
+	if len(users) != memberCount {
+		t.Fatalf("expected %d staged users, got %d", memberCount, len(users))
+	}
+
+	if searcher.searchPagedCalls != 1 {
+		t.Errorf("expected exactly 1 paged search regardless of member count, got %d", searcher.searchPagedCalls)
+	}
+
+	if searcher.searchCalls != 0 {
+		t.Errorf("expected no unpaged searches, got %d", searcher.searchCalls)
+	}
+}
+
+// BenchmarkRefreshStagedLDAPUsersByMemberOf shows that the memberOf staging
+// search does not grow with group size: it is one paged search, unlike
+// refreshStagedLDAPUsersByGroupWalk which issues one lookup per member. As in
+// the test above, no role or org mappings are configured in roleConfigs, so
+// the per-user role and org searches of updateLDAPUserRoles are not counted.
+func BenchmarkRefreshStagedLDAPUsersByMemberOf(b *testing.B) {
+	const memberCount = 10000
+
+	entries := make([]*ldap.Entry, 0, memberCount)
+	for i := 0; i < memberCount; i++ {
+		uid := fmt.Sprintf("user%d", i)
+		entries = append(entries, ldap.NewEntry(fmt.Sprintf("uid=%s,ou=people,dc=example,dc=com", uid), map[string][]string{
+			"uid":  {uid},
+			"mail": {uid + "@example.com"},
+			"cn":   {uid + " Test"},
+		}))
+	}
+
+	searcher := &countingSearcher{entries: entries}
+	sync := &LDAPSync{
+		lc: searcher,
+		cr: &ConfigReader{config: &Config{
+			Directory: DirectoryConfig{
+				Allusers: "ou=people,dc=example,dc=com",
+				Groups:   map[string][]string{"cn=admins,ou=groups,dc=example,dc=com": {"org_admin"}},
+			},
+		}},
+		useMemberOf: true,
+		roleConfigs: [2]*SearchConfig{
+			{config: &map[string][]string{}, filter: "(objectClass=organizationalRole)", attribute: "roleOccupant"},
+			{config: &map[string][]string{}, filter: "(|(objectClass=groupOfNames)(objectClass=group))", attribute: "member"},
+		},
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := sync.refreshStagedLDAPUsersByMemberOf(); err != nil {
+			b.Fatalf("refreshStagedLDAPUsersByMemberOf() returned error: %s", err)
+		}
+	}
+
+	b.ReportMetric(float64(searcher.searchPagedCalls)/float64(b.N), "searches/op")
+}
@@ -0,0 +1,71 @@
+package ldapsync
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// SyncScheduler drives LDAPSync.SyncUsers on a fixed interval, mirroring
+// Gitea's cron.sync_external_users behaviour.
+type SyncScheduler struct {
+	sync       *LDAPSync
+	interval   time.Duration
+	runAtStart bool
+}
+
+// NewSyncScheduler builds a scheduler for sync, using the interval and
+// run-at-start settings from its configuration.
+func NewSyncScheduler(sync *LDAPSync) *SyncScheduler {
+	scheduler := new(SyncScheduler)
+	scheduler.sync = sync
+
+	interval, err := time.ParseDuration(sync.cr.Config().Sync.Interval)
+	if err != nil {
+		Log.Fatalf("Invalid sync interval '%s': %s", sync.cr.Config().Sync.Interval, err.Error())
+	}
+	scheduler.interval = interval
+	scheduler.runAtStart = sync.cr.Config().Sync.RunAtStart
+
+	return scheduler
+}
+
+// Run blocks, firing a full sync cycle every configured interval until ctx is
+// cancelled or a SIGINT/SIGTERM is received. Either way, an in-flight sync is
+// allowed to finish cleanly before Run returns.
+func (scheduler *SyncScheduler) Run(ctx context.Context) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	ticker := time.NewTicker(scheduler.interval)
+	defer ticker.Stop()
+
+	if scheduler.runAtStart {
+		scheduler.runOnce()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			scheduler.runOnce()
+		case <-sigs:
+			Log.Info("Received shutdown signal, finishing the current sync cycle")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (scheduler *SyncScheduler) runOnce() {
+	if _, err := scheduler.sync.Start(); err != nil {
+		Log.Errorf("Sync cycle skipped: %s", err.Error())
+		return
+	}
+
+	scheduler.sync.SyncUsers()
+	scheduler.sync.Finish()
+}
@@ -0,0 +1,116 @@
+package ldapsync
+
+import (
+	"github.com/thoas/go-funk"
+)
+
+// UyuniUser holds the merged view of a single account as seen on the Uyuni
+// side and/or in LDAP, plus the bookkeeping flags the sync uses to decide
+// what needs to happen to it.
+type UyuniUser struct {
+	Dn         string
+	Uid        string
+	Email      string
+	Name       string
+	Secondname string
+	OrgID      int64
+	Err        error
+
+	roles    []string
+	new      bool
+	outdated bool
+	disabled bool
+
+	roleschanged   bool
+	accountchanged bool
+	reactivate     bool
+}
+
+// NewUyuniUser creates an empty user with no roles assigned, defaulting to org ID 1.
+func NewUyuniUser() *UyuniUser {
+	user := new(UyuniUser)
+	user.roles = make([]string, 0)
+	user.OrgID = 1
+	return user
+}
+
+// IsNew tells whether this user does not exist in Uyuni yet.
+func (user *UyuniUser) IsNew() bool {
+	return user.new
+}
+
+// IsOutdated tells whether this user's Uyuni data needs to be refreshed.
+func (user *UyuniUser) IsOutdated() bool {
+	return user.outdated
+}
+
+// IsValid tells whether the last XML-RPC operation on this user succeeded.
+func (user *UyuniUser) IsValid() bool {
+	return user.Err == nil
+}
+
+// IsDisabled tells whether this user is currently disabled in Uyuni.
+func (user *UyuniUser) IsDisabled() bool {
+	return user.disabled
+}
+
+// NeedsReactivation tells whether this user went from absent to present in
+// LDAP and should be re-enabled in Uyuni.
+func (user *UyuniUser) NeedsReactivation() bool {
+	return user.reactivate
+}
+
+// GetRoles returns the roles currently assigned to this user.
+func (user *UyuniUser) GetRoles() []string {
+	return user.roles
+}
+
+// AddRoles appends roles that are not already assigned.
+func (user *UyuniUser) AddRoles(roles ...string) *UyuniUser {
+	for _, role := range roles {
+		if !funk.ContainsString(user.roles, role) {
+			user.roles = append(user.roles, role)
+		}
+	}
+	return user
+}
+
+// FlushRoles clears the assigned roles.
+func (user *UyuniUser) FlushRoles() *UyuniUser {
+	user.roles = make([]string, 0)
+	return user
+}
+
+// Clone returns a deep copy of the user.
+func (user *UyuniUser) Clone() *UyuniUser {
+	clone := NewUyuniUser()
+	clone.Dn = user.Dn
+	clone.Uid = user.Uid
+	clone.Email = user.Email
+	clone.Name = user.Name
+	clone.Secondname = user.Secondname
+	clone.OrgID = user.OrgID
+	clone.Err = user.Err
+	clone.new = user.new
+	clone.outdated = user.outdated
+	clone.disabled = user.disabled
+	clone.roleschanged = user.roleschanged
+	clone.accountchanged = user.accountchanged
+	clone.reactivate = user.reactivate
+	clone.AddRoles(user.roles...)
+	return clone
+}
+
+// CompareRoles reports whether two users have an identical role set,
+// regardless of order.
+func CompareRoles(a, b *UyuniUser) bool {
+	if len(a.roles) != len(b.roles) {
+		return false
+	}
+	for _, role := range a.roles {
+		if !funk.ContainsString(b.roles, role) {
+			return false
+		}
+	}
+	return true
+}